@@ -0,0 +1,53 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+// gRPC Prometheus monitoring interceptors for client-side gRPC.
+
+package grpc_prometheus
+
+import (
+	"google.golang.org/grpc/stats"
+)
+
+var (
+	// DefaultClientMetrics is the default instance of ClientMetrics. It is
+	// intended to be used in conjunction the default Prometheus metrics
+	// registry.
+	DefaultClientMetrics = NewClientMetrics()
+
+	// UnaryClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Unary RPCs.
+	UnaryClientInterceptor = DefaultClientMetrics.UnaryClientInterceptor()
+
+	// StreamClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Streaming RPCs.
+	StreamClientInterceptor = DefaultClientMetrics.StreamClientInterceptor()
+)
+
+// EnableClientHandlingTimeHistogram turns on histograms being registered when
+// registering the ClientMetrics on a Prometheus registry. Histograms can be
+// expensive on Prometheus servers. This function acts on the
+// DefaultClientMetrics variable.
+func EnableClientHandlingTimeHistogram(opts ...HistogramOption) {
+	DefaultClientMetrics.EnableClientHandlingTimeHistogram(opts...)
+}
+
+// EnableClientInFlightGauge turns on the grpc_client_in_flight_requests
+// gauge. This function acts on the DefaultClientMetrics variable.
+func EnableClientInFlightGauge() {
+	DefaultClientMetrics.EnableInFlightGauge()
+}
+
+// EnableClientPayloadSizeHistogram turns on recording of message payload
+// sizes of RPCs. Payload sizes are recorded only by the handler returned by
+// ClientStatsHandler(), so grpc.WithStatsHandler(ClientStatsHandler()) must
+// be passed to grpc.Dial; the interceptors record no payload sizes. This
+// function acts on the DefaultClientMetrics variable.
+func EnableClientPayloadSizeHistogram(opts ...HistogramOption) {
+	DefaultClientMetrics.EnablePayloadSizeHistogram(opts...)
+}
+
+// ClientStatsHandler returns a grpc.StatsHandler that feeds the payload-size
+// histograms enabled via EnableClientPayloadSizeHistogram. It acts on the
+// DefaultClientMetrics variable.
+func ClientStatsHandler() stats.Handler {
+	return DefaultClientMetrics.StatsHandler()
+}
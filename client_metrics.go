@@ -0,0 +1,341 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+	"io"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ClientMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC client.
+type ClientMetrics struct {
+	clientStartedCounter          *prom.CounterVec
+	clientHandledCounter          *prom.CounterVec
+	clientStreamMsgReceived       *prom.CounterVec
+	clientStreamMsgSent           *prom.CounterVec
+	clientHandledHistogramEnabled bool
+	clientHandledHistogramOpts    prom.HistogramOpts
+	clientHandledHistogram        *prom.HistogramVec
+
+	clientInFlightGaugeEnabled bool
+	clientInFlightGauge        *prom.GaugeVec
+
+	clientPayloadHistogramEnabled   bool
+	clientPayloadHistogramOpts      prom.HistogramOpts
+	clientMsgReceivedBytesHistogram *prom.HistogramVec
+	clientMsgSentBytesHistogram     *prom.HistogramVec
+
+	methodFilter MethodFilter
+}
+
+// NewClientMetrics returns a ClientMetrics object. Use a new instance of
+// ClientMetrics when not using the default/global instance.
+func NewClientMetrics(counterOpts ...CounterOption) *ClientMetrics {
+	opts := counterOptions(counterOpts)
+	return &ClientMetrics{
+		clientStartedCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_started_total",
+				Help: "Total number of RPCs started on the client.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		clientHandledCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_handled_total",
+				Help: "Total number of RPCs completed by the client regardless of success or failure.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		clientStreamMsgReceived: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_msg_received_total",
+				Help: "Total number of RPC stream messages received by the client.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		clientStreamMsgSent: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_msg_sent_total",
+				Help: "Total number of gRPC stream messages sent by the client.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		clientHandledHistogramEnabled: false,
+		clientHandledHistogramOpts: prom.HistogramOpts{
+			Name:    "grpc_client_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of the gRPC until it is finished by the application.",
+			Buckets: prom.DefBuckets,
+		},
+		clientHandledHistogram:     nil,
+		clientInFlightGaugeEnabled: false,
+		clientInFlightGauge: prom.NewGaugeVec(
+			prom.GaugeOpts{
+				Name: "grpc_client_in_flight_requests",
+				Help: "Gauge of requests the client currently has in flight.",
+			}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+		clientPayloadHistogramEnabled: false,
+		clientPayloadHistogramOpts: prom.HistogramOpts{
+			Name:    "grpc_client_msg_size_bytes",
+			Help:    "Histogram of message sizes (bytes) received/sent by the client.",
+			Buckets: prom.ExponentialBuckets(32, 2, 10),
+		},
+	}
+}
+
+// EnableClientHandlingTimeHistogram turns on histograms being registered when
+// registering the ClientMetrics on a Prometheus registry. Histograms can be
+// expensive on Prometheus servers. It takes options to configure histogram
+// options such as the defined buckets.
+func (m *ClientMetrics) EnableClientHandlingTimeHistogram(opts ...HistogramOption) {
+	for _, o := range opts {
+		o(&m.clientHandledHistogramOpts)
+	}
+	if !m.clientHandledHistogramEnabled {
+		m.clientHandledHistogram = prom.NewHistogramVec(
+			m.clientHandledHistogramOpts,
+			[]string{"grpc_type", "grpc_service", "grpc_method"},
+		)
+	}
+	m.clientHandledHistogramEnabled = true
+}
+
+// EnableInFlightGauge turns on the grpc_client_in_flight_requests gauge,
+// which tracks the number of RPCs the client currently has outstanding,
+// labeled by service/method/type.
+func (m *ClientMetrics) EnableInFlightGauge() {
+	m.clientInFlightGaugeEnabled = true
+}
+
+// EnablePayloadSizeHistogram turns on the grpc_client_msg_received_bytes and
+// grpc_client_msg_sent_bytes histograms, recorded from a grpc.StatsHandler
+// returned by StatsHandler. Use it alongside grpc.WithStatsHandler(m.StatsHandler())
+// when dialing so that streaming messages are measured without wrapping
+// every ClientStream.
+func (m *ClientMetrics) EnablePayloadSizeHistogram(opts ...HistogramOption) {
+	for _, o := range opts {
+		o(&m.clientPayloadHistogramOpts)
+	}
+	if !m.clientPayloadHistogramEnabled {
+		receivedOpts := m.clientPayloadHistogramOpts
+		receivedOpts.Name = "grpc_client_msg_received_bytes"
+		receivedOpts.Help = "Histogram of message sizes (bytes) received by the client."
+		m.clientMsgReceivedBytesHistogram = prom.NewHistogramVec(
+			receivedOpts, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+		sentOpts := m.clientPayloadHistogramOpts
+		sentOpts.Name = "grpc_client_msg_sent_bytes"
+		sentOpts.Help = "Histogram of message sizes (bytes) sent by the client."
+		m.clientMsgSentBytesHistogram = prom.NewHistogramVec(
+			sentOpts, []string{"grpc_type", "grpc_service", "grpc_method"})
+	}
+	m.clientPayloadHistogramEnabled = true
+}
+
+// SetMethodFilter installs a MethodFilter that the unary and stream
+// interceptors consult for every RPC before recording it. It is a plain
+// setter rather than a With* constructor option since NewClientMetrics takes
+// CounterOption values, not ClientMetrics-level settings.
+func (m *ClientMetrics) SetMethodFilter(filter MethodFilter) {
+	m.methodFilter = filter
+}
+
+// Describe sends the super-set of all possible descriptors of metrics
+// collected by this Collector to the provided channel and returns once
+// the last descriptor has been sent.
+func (m *ClientMetrics) Describe(ch chan<- *prom.Desc) {
+	m.clientStartedCounter.Describe(ch)
+	m.clientHandledCounter.Describe(ch)
+	m.clientStreamMsgReceived.Describe(ch)
+	m.clientStreamMsgSent.Describe(ch)
+	if m.clientHandledHistogramEnabled {
+		m.clientHandledHistogram.Describe(ch)
+	}
+	if m.clientInFlightGaugeEnabled {
+		m.clientInFlightGauge.Describe(ch)
+	}
+	if m.clientPayloadHistogramEnabled {
+		m.clientMsgReceivedBytesHistogram.Describe(ch)
+		m.clientMsgSentBytesHistogram.Describe(ch)
+	}
+}
+
+// Collect is called by the Prometheus registry when collecting metrics.
+func (m *ClientMetrics) Collect(ch chan<- prom.Metric) {
+	m.clientStartedCounter.Collect(ch)
+	m.clientHandledCounter.Collect(ch)
+	m.clientStreamMsgReceived.Collect(ch)
+	m.clientStreamMsgSent.Collect(ch)
+	if m.clientHandledHistogramEnabled {
+		m.clientHandledHistogram.Collect(ch)
+	}
+	if m.clientInFlightGaugeEnabled {
+		m.clientInFlightGauge.Collect(ch)
+	}
+	if m.clientPayloadHistogramEnabled {
+		m.clientMsgReceivedBytesHistogram.Collect(ch)
+		m.clientMsgSentBytesHistogram.Collect(ch)
+	}
+}
+
+// UnaryClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Unary RPCs.
+func (m *ClientMetrics) UnaryClientInterceptor() func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return func(ctx context.Context, fullMethod string, req, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		monitor, ok := newClientReporter(m, Unary, fullMethod)
+		if !ok {
+			return invoker(ctx, fullMethod, req, reply, conn, callOpts...)
+		}
+		monitor.SentMessage()
+		if m.clientInFlightGaugeEnabled {
+			monitor.InFlightInc()
+			defer monitor.InFlightDec()
+		}
+		err := invoker(ctx, fullMethod, req, reply, conn, callOpts...)
+		st, _ := status.FromError(err)
+		if err == nil {
+			monitor.ReceivedMessage()
+		}
+		monitor.Handled(st.Code())
+		return err
+	}
+}
+
+// StreamClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Streaming RPCs.
+func (m *ClientMetrics) StreamClientInterceptor() func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return func(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, fullMethod string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		monitor, ok := newClientReporter(m, clientStreamType(desc), fullMethod)
+		if !ok {
+			return streamer(ctx, desc, conn, fullMethod, callOpts...)
+		}
+		if m.clientInFlightGaugeEnabled {
+			monitor.InFlightInc()
+		}
+		clientStream, err := streamer(ctx, desc, conn, fullMethod, callOpts...)
+		if err != nil {
+			if m.clientInFlightGaugeEnabled {
+				monitor.InFlightDec()
+			}
+			st, _ := status.FromError(err)
+			monitor.Handled(st.Code())
+			return nil, err
+		}
+		return &monitoredClientStream{
+			ClientStream:         clientStream,
+			monitor:              monitor,
+			inFlightGaugeEnabled: m.clientInFlightGaugeEnabled,
+			serverStreams:        desc.ServerStreams,
+		}, nil
+	}
+}
+
+func clientStreamType(desc *grpc.StreamDesc) grpcType {
+	if desc.ClientStreams && !desc.ServerStreams {
+		return ClientStream
+	} else if !desc.ClientStreams && desc.ServerStreams {
+		return ServerStream
+	}
+	return BidiStream
+}
+
+// monitoredClientStream wraps grpc.ClientStream allowing each Sent/Recv of
+// message to increment counters and finalizes the RPC once the stream
+// reports io.EOF or an error, or once the first message is received on a
+// non-server-streaming RPC (grpc-go's own clientStream.RecvMsg treats that
+// as end-of-stream too, and never returns io.EOF to the caller for these).
+type monitoredClientStream struct {
+	grpc.ClientStream
+	monitor              *clientReporter
+	inFlightGaugeEnabled bool
+	serverStreams        bool
+	finished             bool
+}
+
+func (s *monitoredClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.monitor.SentMessage()
+	}
+	return err
+}
+
+func (s *monitoredClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.monitor.ReceivedMessage()
+		if !s.serverStreams {
+			s.finish(nil)
+		}
+		return nil
+	}
+	s.finish(err)
+	return err
+}
+
+func (s *monitoredClientStream) finish(err error) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	if s.inFlightGaugeEnabled {
+		s.monitor.InFlightDec()
+	}
+	st, _ := status.FromError(err)
+	if err == nil || err == io.EOF {
+		st = status.New(codes.OK, "")
+	}
+	s.monitor.Handled(st.Code())
+}
+
+// clientReporter tracks the lifecycle of a single client RPC and feeds the
+// corresponding metrics of the owning ClientMetrics.
+type clientReporter struct {
+	metrics     *ClientMetrics
+	rpcType     grpcType
+	serviceName string
+	methodName  string
+	startTime   time.Time
+}
+
+// newClientReporter resolves the service/method labels for fullMethod
+// through the configured MethodFilter and starts tracking the RPC. The
+// second return value is false when the filter asked for the RPC to be
+// dropped from observation entirely, in which case the returned reporter is
+// nil and must not be used.
+func newClientReporter(m *ClientMetrics, rpcType grpcType, fullMethod string) (*clientReporter, bool) {
+	serviceName, methodName, keep := filterMethodLabels(m.methodFilter, fullMethod)
+	if !keep {
+		return nil, false
+	}
+	r := &clientReporter{
+		metrics:     m,
+		rpcType:     rpcType,
+		serviceName: serviceName,
+		methodName:  methodName,
+		startTime:   time.Now(),
+	}
+	r.metrics.clientStartedCounter.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+	return r, true
+}
+
+func (r *clientReporter) ReceivedMessage() {
+	r.metrics.clientStreamMsgReceived.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *clientReporter) SentMessage() {
+	r.metrics.clientStreamMsgSent.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *clientReporter) InFlightInc() {
+	r.metrics.clientInFlightGauge.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *clientReporter) InFlightDec() {
+	r.metrics.clientInFlightGauge.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Dec()
+}
+
+func (r *clientReporter) Handled(code codes.Code) {
+	r.metrics.clientHandledCounter.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName, code.String()).Inc()
+	if r.metrics.clientHandledHistogramEnabled {
+		r.metrics.clientHandledHistogram.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Observe(time.Since(r.startTime).Seconds())
+	}
+}
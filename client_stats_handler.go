@@ -0,0 +1,59 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+
+	"google.golang.org/grpc/stats"
+)
+
+// clientPayloadStatsHandler is a grpc.StatsHandler that records payload
+// sizes for outbound and inbound messages into the
+// grpc_client_msg_sent_bytes and grpc_client_msg_received_bytes histograms.
+// Like payloadStatsHandler on the server side, it observes stream messages
+// without requiring a ClientStream wrapper.
+type clientPayloadStatsHandler struct {
+	metrics *ClientMetrics
+}
+
+// StatsHandler returns a grpc.StatsHandler that feeds the payload-size
+// histograms enabled via EnablePayloadSizeHistogram. Pass it to grpc.Dial
+// via grpc.WithStatsHandler(m.StatsHandler()).
+func (m *ClientMetrics) StatsHandler() stats.Handler {
+	return &clientPayloadStatsHandler{metrics: m}
+}
+
+func (h *clientPayloadStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	serviceName, methodName, keep := filterMethodLabels(h.metrics.methodFilter, info.FullMethodName)
+	return context.WithValue(ctx, payloadStatsHandlerKey{}, payloadStatsLabels{
+		serviceName: serviceName,
+		methodName:  methodName,
+		keep:        keep,
+	})
+}
+
+func (h *clientPayloadStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if !h.metrics.clientPayloadHistogramEnabled {
+		return
+	}
+	labels, ok := ctx.Value(payloadStatsHandlerKey{}).(payloadStatsLabels)
+	if !ok || !labels.keep {
+		return
+	}
+	switch p := s.(type) {
+	case *stats.OutPayload:
+		h.metrics.clientMsgSentBytesHistogram.WithLabelValues(
+			payloadGRPCType, labels.serviceName, labels.methodName).Observe(float64(p.Length))
+	case *stats.InPayload:
+		h.metrics.clientMsgReceivedBytesHistogram.WithLabelValues(
+			payloadGRPCType, labels.serviceName, labels.methodName).Observe(float64(p.Length))
+	}
+}
+
+func (h *clientPayloadStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *clientPayloadStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
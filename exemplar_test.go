@@ -0,0 +1,74 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+)
+
+func writeMetric(t *testing.T, collector prom.Metric) *dto.Metric {
+	t.Helper()
+	var out dto.Metric
+	if err := collector.Write(&out); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	return &out
+}
+
+func TestUnaryServerInterceptor_AttachesExemplarWhenLabelsPresent(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram()
+	m.SetExemplarFromContext(func(ctx context.Context) prom.Labels {
+		return prom.Labels{"trace_id": "abc123"}
+	})
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+		t.Fatalf("interceptor returned error: %v", err)
+	}
+
+	counter := m.serverHandledCounter.WithLabelValues(string(Unary), "test.Service", "Method", "OK")
+	if pb := writeMetric(t, counter.(prom.Metric)); pb.Counter.Exemplar == nil {
+		t.Error("expected an exemplar on the handled counter, got none")
+	}
+
+	histogram := m.serverHandledHistogram.WithLabelValues(string(Unary), "test.Service", "Method")
+	pb := writeMetric(t, histogram.(prom.Metric))
+	found := false
+	for _, bucket := range pb.Histogram.Bucket {
+		if bucket.Exemplar != nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("expected an exemplar on one of the handling time histogram buckets, got none")
+	}
+}
+
+func TestUnaryServerInterceptor_NoExemplarWhenExtractorReturnsNil(t *testing.T) {
+	m := NewServerMetrics()
+	m.SetExemplarFromContext(func(ctx context.Context) prom.Labels { return nil })
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+		t.Fatalf("interceptor returned error: %v", err)
+	}
+
+	counter := m.serverHandledCounter.WithLabelValues(string(Unary), "test.Service", "Method", "OK")
+	pb := writeMetric(t, counter.(prom.Metric))
+	if pb.Counter.GetValue() != 1 {
+		t.Errorf("expected the counter to still be incremented, got %v", pb.Counter.GetValue())
+	}
+	if pb.Counter.Exemplar != nil {
+		t.Error("expected no exemplar when the extractor returns nil labels")
+	}
+}
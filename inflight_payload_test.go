@@ -0,0 +1,167 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+)
+
+func sampleCount(t *testing.T, o prom.Observer) uint64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := o.(prom.Metric).Write(&pb); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	return pb.Histogram.GetSampleCount()
+}
+
+func TestUnaryServerInterceptor_InFlightGaugeReturnsToZero(t *testing.T) {
+	for _, handlerErr := range []error{nil, errors.New("boom")} {
+		m := NewServerMetrics()
+		m.EnableInFlightGauge()
+		info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			if got := testutil.ToFloat64(m.serverInFlightGauge.WithLabelValues(string(Unary), "test.Service", "Method")); got != 1 {
+				t.Errorf("expected gauge to be 1 mid-call, got %v", got)
+			}
+			return nil, handlerErr
+		}
+		if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != handlerErr {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := testutil.ToFloat64(m.serverInFlightGauge.WithLabelValues(string(Unary), "test.Service", "Method")); got != 0 {
+			t.Errorf("expected gauge to return to 0 after the call (err=%v), got %v", handlerErr, got)
+		}
+	}
+}
+
+// fakeClientStream is a minimal grpc.ClientStream that succeeds once before
+// reporting io.EOF, mimicking a server stream with a single response message.
+type fakeClientStream struct {
+	recvCalls int
+}
+
+func (f *fakeClientStream) Header() (metadata.MD, error) { return nil, nil }
+func (f *fakeClientStream) Trailer() metadata.MD         { return nil }
+func (f *fakeClientStream) CloseSend() error             { return nil }
+func (f *fakeClientStream) Context() context.Context     { return context.Background() }
+func (f *fakeClientStream) SendMsg(m interface{}) error  { return nil }
+func (f *fakeClientStream) RecvMsg(m interface{}) error {
+	f.recvCalls++
+	if f.recvCalls == 1 {
+		return nil
+	}
+	return io.EOF
+}
+
+func TestStreamClientInterceptor_InFlightGaugeTracksStreamLifetime(t *testing.T) {
+	m := NewClientMetrics()
+	m.EnableInFlightGauge()
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{}, nil
+	}
+
+	cs, err := m.StreamClientInterceptor()(context.Background(), desc, nil, "/test.Service/Method", streamer)
+	if err != nil {
+		t.Fatalf("unexpected error opening stream: %v", err)
+	}
+	if got := testutil.ToFloat64(m.clientInFlightGauge.WithLabelValues(string(ServerStream), "test.Service", "Method")); got != 1 {
+		t.Fatalf("expected gauge to be 1 once the stream is open, got %v", got)
+	}
+
+	if err := cs.RecvMsg(new(interface{})); err != nil {
+		t.Fatalf("unexpected error on first RecvMsg: %v", err)
+	}
+	if got := testutil.ToFloat64(m.clientInFlightGauge.WithLabelValues(string(ServerStream), "test.Service", "Method")); got != 1 {
+		t.Errorf("expected gauge to still be 1 mid-stream, got %v", got)
+	}
+
+	if err := cs.RecvMsg(new(interface{})); err != io.EOF {
+		t.Fatalf("expected io.EOF from final RecvMsg, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.clientInFlightGauge.WithLabelValues(string(ServerStream), "test.Service", "Method")); got != 0 {
+		t.Errorf("expected gauge to return to 0 once the stream finishes, got %v", got)
+	}
+}
+
+// TestStreamClientInterceptor_NonServerStreamingFinishesOnFirstRecv covers
+// client-streaming (and bidi) RPCs, where grpc-go's own clientStream.RecvMsg
+// treats a non-server-streaming RPC's first successful receive as the end of
+// the stream and never returns io.EOF afterwards (the standard CloseAndRecv()
+// pattern generated stubs use calls RecvMsg exactly once).
+func TestStreamClientInterceptor_NonServerStreamingFinishesOnFirstRecv(t *testing.T) {
+	m := NewClientMetrics()
+	m.EnableInFlightGauge()
+	desc := &grpc.StreamDesc{ClientStreams: true}
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{}, nil
+	}
+
+	cs, err := m.StreamClientInterceptor()(context.Background(), desc, nil, "/test.Service/Method", streamer)
+	if err != nil {
+		t.Fatalf("unexpected error opening stream: %v", err)
+	}
+	if got := testutil.ToFloat64(m.clientInFlightGauge.WithLabelValues(string(ClientStream), "test.Service", "Method")); got != 1 {
+		t.Fatalf("expected gauge to be 1 once the stream is open, got %v", got)
+	}
+
+	if err := cs.RecvMsg(new(interface{})); err != nil {
+		t.Fatalf("unexpected error from CloseAndRecv-style RecvMsg: %v", err)
+	}
+	if got := testutil.ToFloat64(m.clientInFlightGauge.WithLabelValues(string(ClientStream), "test.Service", "Method")); got != 0 {
+		t.Errorf("expected gauge to return to 0 after the single RecvMsg, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.clientHandledCounter.WithLabelValues(string(ClientStream), "test.Service", "Method", "OK")); got != 1 {
+		t.Errorf("expected clientHandledCounter to be incremented, got %v", got)
+	}
+}
+
+func TestServerPayloadStatsHandler_RecordsMessageSizes(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnablePayloadSizeHistogram()
+	handler := m.StatsHandler()
+
+	ctx := handler.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/test.Service/Method"})
+	handler.HandleRPC(ctx, &stats.InPayload{Length: 128})
+	handler.HandleRPC(ctx, &stats.OutPayload{Length: 256})
+
+	received := m.serverMsgReceivedBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "Method")
+	if got := sampleCount(t, received); got != 1 {
+		t.Errorf("expected 1 received-bytes observation, got %d", got)
+	}
+	sent := m.serverMsgSentBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "Method")
+	if got := sampleCount(t, sent); got != 1 {
+		t.Errorf("expected 1 sent-bytes observation, got %d", got)
+	}
+}
+
+func TestClientPayloadStatsHandler_RecordsMessageSizes(t *testing.T) {
+	m := NewClientMetrics()
+	m.EnablePayloadSizeHistogram()
+	handler := m.StatsHandler()
+
+	ctx := handler.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/test.Service/Method"})
+	handler.HandleRPC(ctx, &stats.OutPayload{Length: 64})
+	handler.HandleRPC(ctx, &stats.InPayload{Length: 512})
+
+	sent := m.clientMsgSentBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "Method")
+	if got := sampleCount(t, sent); got != 1 {
+		t.Errorf("expected 1 sent-bytes observation, got %d", got)
+	}
+	received := m.clientMsgReceivedBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "Method")
+	if got := sampleCount(t, received); got != 1 {
+		t.Errorf("expected 1 received-bytes observation, got %d", got)
+	}
+}
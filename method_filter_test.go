@@ -0,0 +1,143 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+func TestFilterMethodLabels(t *testing.T) {
+	t.Run("no filter splits the full method as usual", func(t *testing.T) {
+		service, method, keep := filterMethodLabels(nil, "/test.Service/Method")
+		if !keep || service != "test.Service" || method != "Method" {
+			t.Fatalf("got (%q, %q, %v)", service, method, keep)
+		}
+	})
+
+	t.Run("keep=false drops the RPC", func(t *testing.T) {
+		filter := func(fullMethod string) (string, string, bool) { return "", "", false }
+		if _, _, keep := filterMethodLabels(filter, "/test.Service/Method"); keep {
+			t.Fatal("expected keep=false to be honored")
+		}
+	})
+
+	t.Run("non-empty service/method rewrite the parsed labels", func(t *testing.T) {
+		filter := func(fullMethod string) (string, string, bool) { return "rewritten.Service", "", true }
+		service, method, keep := filterMethodLabels(filter, "/test.Service/Method")
+		if !keep || service != "rewritten.Service" || method != "Method" {
+			t.Fatalf("got (%q, %q, %v)", service, method, keep)
+		}
+	})
+}
+
+func TestUnaryServerInterceptor_MethodFilterDropsRPC(t *testing.T) {
+	m := NewServerMetrics()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) { return "", "", false })
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	handlerCalled := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerCalled = true
+		return nil, nil
+	}
+
+	if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !handlerCalled {
+		t.Fatal("expected the handler to still run even though the RPC is filtered out")
+	}
+	if got := testutil.ToFloat64(m.serverStartedCounter.WithLabelValues(string(Unary), "grpc.health.v1.Health", "Check")); got != 0 {
+		t.Errorf("expected no metric to be recorded for a filtered-out method, got %v", got)
+	}
+}
+
+func TestUnaryServerInterceptor_MethodFilterRewritesLabels(t *testing.T) {
+	m := NewServerMetrics()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) {
+		return "grouped.Service", "grouped_method", true
+	})
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	if _, err := m.UnaryServerInterceptor()(context.Background(), nil, info, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(m.serverStartedCounter.WithLabelValues(string(Unary), "grouped.Service", "grouped_method")); got != 1 {
+		t.Errorf("expected the rewritten labels to receive the observation, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.serverStartedCounter.WithLabelValues(string(Unary), "test.Service", "Method")); got != 0 {
+		t.Errorf("expected the original labels to receive no observation, got %v", got)
+	}
+}
+
+func TestStreamServerInterceptor_MethodFilterDropsRPC(t *testing.T) {
+	m := NewServerMetrics()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) { return "", "", false })
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream", IsServerStream: true}
+	var gotStream grpc.ServerStream
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		gotStream = ss
+		return nil
+	}
+
+	fakeStream := &fakeServerStream{ctx: context.Background()}
+	if err := m.StreamServerInterceptor()(nil, fakeStream, info, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotStream != fakeStream {
+		t.Error("expected the raw ServerStream to pass through unwrapped when the RPC is filtered out")
+	}
+	if got := testutil.ToFloat64(m.serverStartedCounter.WithLabelValues(string(ServerStream), "test.Service", "Stream")); got != 0 {
+		t.Errorf("expected no metric to be recorded for a filtered-out method, got %v", got)
+	}
+}
+
+// fakeServerStream is a minimal grpc.ServerStream used to observe whether the
+// interceptor wraps it in a monitoredServerStream.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context { return f.ctx }
+
+func TestUnaryClientInterceptor_MethodFilterDropsRPC(t *testing.T) {
+	m := NewClientMetrics()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) { return "", "", false })
+	invokerCalled := false
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		invokerCalled = true
+		return nil
+	}
+
+	if err := m.UnaryClientInterceptor()(context.Background(), "/test.Service/Method", nil, nil, nil, invoker); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !invokerCalled {
+		t.Fatal("expected the invoker to still run even though the RPC is filtered out")
+	}
+	if got := testutil.ToFloat64(m.clientStartedCounter.WithLabelValues(string(Unary), "test.Service", "Method")); got != 0 {
+		t.Errorf("expected no metric to be recorded for a filtered-out method, got %v", got)
+	}
+}
+
+func TestPayloadStatsHandler_MethodFilterSuppressesObservations(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnablePayloadSizeHistogram()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) { return "", "", false })
+	handler := m.StatsHandler()
+
+	ctx := handler.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/test.Service/Method"})
+	handler.HandleRPC(ctx, &stats.InPayload{Length: 128})
+
+	received := m.serverMsgReceivedBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "Method")
+	if got := sampleCount(t, received); got != 0 {
+		t.Errorf("expected no observation for a filtered-out method, got %d samples", got)
+	}
+}
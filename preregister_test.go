@@ -0,0 +1,84 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+// newTestServiceServer registers a fake service with one unary and one
+// bidi-streaming method on a *grpc.Server so InitializeMetrics has
+// service/method info to pre-register against, without needing a listener.
+func newTestServiceServer() *grpc.Server {
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Service",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "UnaryMethod"},
+		},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "StreamMethod", ClientStreams: true, ServerStreams: true},
+		},
+	}, nil)
+	return srv
+}
+
+func TestServerMetrics_InitializeMetrics_PreRegistersInFlightGaugeAndPayloadHistograms(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableInFlightGauge()
+	m.EnablePayloadSizeHistogram()
+
+	m.InitializeMetrics(newTestServiceServer())
+
+	if got := testutil.CollectAndCount(m.serverInFlightGauge); got != 2 {
+		t.Errorf("expected the in-flight gauge to be pre-registered for both methods, got %d series", got)
+	}
+	if got := testutil.ToFloat64(m.serverInFlightGauge.WithLabelValues(string(Unary), "test.Service", "UnaryMethod")); got != 0 {
+		t.Errorf("expected pre-registered in-flight gauge to start at 0, got %v", got)
+	}
+
+	if got := testutil.CollectAndCount(m.serverMsgReceivedBytesHistogram); got != 2 {
+		t.Errorf("expected the received-bytes histogram to be pre-registered for both methods, got %d series", got)
+	}
+	if got := testutil.CollectAndCount(m.serverMsgSentBytesHistogram); got != 2 {
+		t.Errorf("expected the sent-bytes histogram to be pre-registered for both methods, got %d series", got)
+	}
+
+	// Pre-registration must use the same grpc_type="all" label that the stats
+	// handler records at runtime (see 1f768a0); fetching that exact series
+	// must not create a second one.
+	before := testutil.CollectAndCount(m.serverMsgReceivedBytesHistogram)
+	m.serverMsgReceivedBytesHistogram.WithLabelValues(payloadGRPCType, "test.Service", "UnaryMethod")
+	if after := testutil.CollectAndCount(m.serverMsgReceivedBytesHistogram); after != before {
+		t.Errorf("expected pre-registration to already use grpc_type=%q, got a new series (before=%d, after=%d)", payloadGRPCType, before, after)
+	}
+}
+
+func TestServerMetrics_InitializeMetrics_MethodFilterDropsMethod(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableInFlightGauge()
+	m.EnablePayloadSizeHistogram()
+	m.SetMethodFilter(func(fullMethod string) (string, string, bool) {
+		return "", "", fullMethod != "/test.Service/StreamMethod"
+	})
+
+	m.InitializeMetrics(newTestServiceServer())
+
+	if got := testutil.CollectAndCount(m.serverInFlightGauge); got != 1 {
+		t.Errorf("expected the filtered-out method's in-flight gauge to be skipped, got %d series", got)
+	}
+	if got := testutil.CollectAndCount(m.serverMsgReceivedBytesHistogram); got != 1 {
+		t.Errorf("expected the filtered-out method's received-bytes histogram to be skipped, got %d series", got)
+	}
+	if got := testutil.CollectAndCount(m.serverMsgSentBytesHistogram); got != 1 {
+		t.Errorf("expected the filtered-out method's sent-bytes histogram to be skipped, got %d series", got)
+	}
+	if got := testutil.CollectAndCount(m.serverStartedCounter); got != 1 {
+		t.Errorf("expected the filtered-out method to be skipped entirely, got %d series", got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	prom "github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
 )
 
 var (
@@ -43,6 +44,28 @@ func EnableHandlingTimeHistogram(opts ...HistogramOption) {
 	DefaultServerMetrics.EnableHandlingTimeHistogram(opts...)
 }
 
+// EnableInFlightGauge turns on the grpc_server_in_flight_requests gauge.
+// This function acts on the DefaultServerMetrics.
+func EnableInFlightGauge() {
+	DefaultServerMetrics.EnableInFlightGauge()
+}
+
+// EnablePayloadSizeHistogram turns on recording of message payload sizes of
+// RPCs. Payload sizes are recorded only by the handler returned by
+// StatsHandler(), so grpc.StatsHandler(StatsHandler()) must be passed to
+// grpc.NewServer; the interceptors record no payload sizes. This function
+// acts on the DefaultServerMetrics.
+func EnablePayloadSizeHistogram(opts ...HistogramOption) {
+	DefaultServerMetrics.EnablePayloadSizeHistogram(opts...)
+}
+
+// StatsHandler returns a grpc.StatsHandler that feeds the payload-size
+// histograms enabled via EnablePayloadSizeHistogram. It acts on the
+// DefaultServerMetrics.
+func StatsHandler() stats.Handler {
+	return DefaultServerMetrics.StatsHandler()
+}
+
 func RegisterDefaultServerMetricsWithRegisterer(reg prom.Registerer) (alreadyRegistered bool, err error) {
 	defaultServerMetricsPromRegistrationMu.Lock()
 
@@ -98,5 +121,24 @@ func RegisterDefaultServerMetricsWithRegisterer(reg prom.Registerer) (alreadyReg
 		registeredMetrics = append(registeredMetrics, DefaultServerMetrics.serverHandledHistogram)
 	}
 
+	if DefaultServerMetrics.serverInFlightGaugeEnabled {
+		if err = reg.Register(DefaultServerMetrics.serverInFlightGauge); err != nil {
+			return
+		}
+		registeredMetrics = append(registeredMetrics, DefaultServerMetrics.serverInFlightGauge)
+	}
+
+	if DefaultServerMetrics.serverPayloadHistogramEnabled {
+		if err = reg.Register(DefaultServerMetrics.serverMsgReceivedBytesHistogram); err != nil {
+			return
+		}
+		registeredMetrics = append(registeredMetrics, DefaultServerMetrics.serverMsgReceivedBytesHistogram)
+
+		if err = reg.Register(DefaultServerMetrics.serverMsgSentBytesHistogram); err != nil {
+			return
+		}
+		registeredMetrics = append(registeredMetrics, DefaultServerMetrics.serverMsgSentBytesHistogram)
+	}
+
 	return
 }
@@ -0,0 +1,398 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"context"
+	"io"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC server.
+type ServerMetrics struct {
+	serverStartedCounter          *prom.CounterVec
+	serverHandledCounter          *prom.CounterVec
+	serverStreamMsgReceived       *prom.CounterVec
+	serverStreamMsgSent           *prom.CounterVec
+	serverHandledHistogramEnabled bool
+	serverHandledHistogramOpts    prom.HistogramOpts
+	serverHandledHistogram        *prom.HistogramVec
+
+	serverInFlightGaugeEnabled bool
+	serverInFlightGauge        *prom.GaugeVec
+
+	serverPayloadHistogramEnabled   bool
+	serverPayloadHistogramOpts      prom.HistogramOpts
+	serverMsgReceivedBytesHistogram *prom.HistogramVec
+	serverMsgSentBytesHistogram     *prom.HistogramVec
+
+	exemplarFromCtx func(ctx context.Context) prom.Labels
+
+	methodFilter MethodFilter
+}
+
+// NewServerMetrics returns a ServerMetrics object. Use a new instance of
+// ServerMetrics when not using the default/global instance.
+func NewServerMetrics(counterOpts ...CounterOption) *ServerMetrics {
+	opts := counterOptions(counterOpts)
+	return &ServerMetrics{
+		serverStartedCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_server_started_total",
+				Help: "Total number of RPCs started on the server.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		serverHandledCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_server_handled_total",
+				Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		serverStreamMsgReceived: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_server_msg_received_total",
+				Help: "Total number of RPC stream messages received on the server.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		serverStreamMsgSent: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_server_msg_sent_total",
+				Help: "Total number of gRPC stream messages sent by the server.",
+			}), []string{"grpc_type", "grpc_service", "grpc_method"}),
+		serverHandledHistogramEnabled: false,
+		serverHandledHistogramOpts: prom.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+			Buckets: prom.DefBuckets,
+		},
+		serverHandledHistogram:     nil,
+		serverInFlightGaugeEnabled: false,
+		serverInFlightGauge: prom.NewGaugeVec(
+			prom.GaugeOpts{
+				Name: "grpc_server_in_flight_requests",
+				Help: "Gauge of requests currently being served by the server.",
+			}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+		serverPayloadHistogramEnabled: false,
+		serverPayloadHistogramOpts: prom.HistogramOpts{
+			Name:    "grpc_server_msg_size_bytes",
+			Help:    "Histogram of message sizes (bytes) received/sent by the server.",
+			Buckets: prom.ExponentialBuckets(32, 2, 10),
+		},
+	}
+}
+
+// EnableHandlingTimeHistogram enables histograms being registered when
+// registering the ServerMetrics on a Prometheus registry. Histograms can be
+// expensive on Prometheus servers. It takes options to configure histogram
+// options such as the defined buckets.
+func (m *ServerMetrics) EnableHandlingTimeHistogram(opts ...HistogramOption) {
+	for _, o := range opts {
+		o(&m.serverHandledHistogramOpts)
+	}
+	if !m.serverHandledHistogramEnabled {
+		m.serverHandledHistogram = prom.NewHistogramVec(
+			m.serverHandledHistogramOpts,
+			[]string{"grpc_type", "grpc_service", "grpc_method"},
+		)
+	}
+	m.serverHandledHistogramEnabled = true
+}
+
+// EnableInFlightGauge turns on the grpc_server_in_flight_requests gauge,
+// which tracks the number of RPCs currently being served, labeled by
+// service/method/type. This gives operators a saturation signal that
+// complements the handled counters and histograms.
+func (m *ServerMetrics) EnableInFlightGauge() {
+	m.serverInFlightGaugeEnabled = true
+}
+
+// EnablePayloadSizeHistogram turns on the grpc_server_msg_received_bytes and
+// grpc_server_msg_sent_bytes histograms, recorded from a grpc.StatsHandler
+// returned by StatsHandler. Use it alongside grpc.StatsHandler(m.StatsHandler())
+// when constructing the gRPC server so that streaming messages are measured
+// without wrapping every ServerStream.
+func (m *ServerMetrics) EnablePayloadSizeHistogram(opts ...HistogramOption) {
+	for _, o := range opts {
+		o(&m.serverPayloadHistogramOpts)
+	}
+	if !m.serverPayloadHistogramEnabled {
+		receivedOpts := m.serverPayloadHistogramOpts
+		receivedOpts.Name = "grpc_server_msg_received_bytes"
+		receivedOpts.Help = "Histogram of message sizes (bytes) received by the server."
+		m.serverMsgReceivedBytesHistogram = prom.NewHistogramVec(
+			receivedOpts, []string{"grpc_type", "grpc_service", "grpc_method"})
+
+		sentOpts := m.serverPayloadHistogramOpts
+		sentOpts.Name = "grpc_server_msg_sent_bytes"
+		sentOpts.Help = "Histogram of message sizes (bytes) sent by the server."
+		m.serverMsgSentBytesHistogram = prom.NewHistogramVec(
+			sentOpts, []string{"grpc_type", "grpc_service", "grpc_method"})
+	}
+	m.serverPayloadHistogramEnabled = true
+}
+
+// SetExemplarFromContext sets a function that extracts OpenMetrics exemplar
+// labels (e.g. trace_id/span_id pulled from the RPC context) to attach to the
+// handled counter and handling time histogram observations. If the function
+// returns nil, no exemplar is attached for that observation. This lets
+// callers bridge gRPC metrics to their tracing backend so Prometheus scrapes
+// carry jump-to-trace links. It is a plain setter rather than a With*
+// constructor option since NewServerMetrics takes CounterOption values, not
+// ServerMetrics-level settings.
+func (m *ServerMetrics) SetExemplarFromContext(exemplarFromCtx func(ctx context.Context) prom.Labels) {
+	m.exemplarFromCtx = exemplarFromCtx
+}
+
+// SetMethodFilter installs a MethodFilter that the unary and stream
+// interceptors consult for every RPC before recording it. It is a plain
+// setter rather than a With* constructor option since NewServerMetrics takes
+// CounterOption values, not ServerMetrics-level settings.
+func (m *ServerMetrics) SetMethodFilter(filter MethodFilter) {
+	m.methodFilter = filter
+}
+
+// Describe sends the super-set of all possible descriptors of metrics
+// collected by this Collector to the provided channel and returns once
+// the last descriptor has been sent.
+func (m *ServerMetrics) Describe(ch chan<- *prom.Desc) {
+	m.serverStartedCounter.Describe(ch)
+	m.serverHandledCounter.Describe(ch)
+	m.serverStreamMsgReceived.Describe(ch)
+	m.serverStreamMsgSent.Describe(ch)
+	if m.serverHandledHistogramEnabled {
+		m.serverHandledHistogram.Describe(ch)
+	}
+	if m.serverInFlightGaugeEnabled {
+		m.serverInFlightGauge.Describe(ch)
+	}
+	if m.serverPayloadHistogramEnabled {
+		m.serverMsgReceivedBytesHistogram.Describe(ch)
+		m.serverMsgSentBytesHistogram.Describe(ch)
+	}
+}
+
+// Collect is called by the Prometheus registry when collecting metrics.
+func (m *ServerMetrics) Collect(ch chan<- prom.Metric) {
+	m.serverStartedCounter.Collect(ch)
+	m.serverHandledCounter.Collect(ch)
+	m.serverStreamMsgReceived.Collect(ch)
+	m.serverStreamMsgSent.Collect(ch)
+	if m.serverHandledHistogramEnabled {
+		m.serverHandledHistogram.Collect(ch)
+	}
+	if m.serverInFlightGaugeEnabled {
+		m.serverInFlightGauge.Collect(ch)
+	}
+	if m.serverPayloadHistogramEnabled {
+		m.serverMsgReceivedBytesHistogram.Collect(ch)
+		m.serverMsgSentBytesHistogram.Collect(ch)
+	}
+}
+
+// UnaryServerInterceptor is a gRPC server-side interceptor that provides Prometheus monitoring for Unary RPCs.
+func (m *ServerMetrics) UnaryServerInterceptor() func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		monitor, ok := newServerReporter(m, Unary, info.FullMethod)
+		if !ok {
+			return handler(ctx, req)
+		}
+		monitor.ReceivedMessage()
+		if m.serverInFlightGaugeEnabled {
+			monitor.InFlightInc()
+			defer monitor.InFlightDec()
+		}
+		resp, err := handler(ctx, req)
+		st, _ := status.FromError(err)
+		monitor.Handled(ctx, st.Code())
+		if err == nil {
+			monitor.SentMessage()
+		}
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is a gRPC server-side interceptor that provides Prometheus monitoring for Streaming RPCs.
+func (m *ServerMetrics) StreamServerInterceptor() func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		monitor, ok := newServerReporter(m, streamRPCType(info), info.FullMethod)
+		if !ok {
+			return handler(srv, ss)
+		}
+		if m.serverInFlightGaugeEnabled {
+			monitor.InFlightInc()
+			defer monitor.InFlightDec()
+		}
+		err := handler(srv, &monitoredServerStream{ServerStream: ss, monitor: monitor})
+		st, _ := status.FromError(err)
+		monitor.Handled(ss.Context(), st.Code())
+		return err
+	}
+}
+
+func streamRPCType(info *grpc.StreamServerInfo) grpcType {
+	if info.IsClientStream && !info.IsServerStream {
+		return ClientStream
+	} else if !info.IsClientStream && info.IsServerStream {
+		return ServerStream
+	}
+	return BidiStream
+}
+
+// InitializeMetrics initializes all metrics, with their appropriate null
+// value, for all gRPC methods registered on a gRPC server. This is useful,
+// to ensure that all metrics exist when collecting and querying. Methods for
+// which the MethodFilter returns keep=false are skipped, and the filter's
+// rewritten service/method labels are used for the others.
+func (m *ServerMetrics) InitializeMetrics(server *grpc.Server) {
+	serviceInfo := server.GetServiceInfo()
+	for serviceName, info := range serviceInfo {
+		for _, mInfo := range info.Methods {
+			preRegisterMethod(m, serviceName, &mInfo)
+		}
+	}
+}
+
+// monitoredServerStream wraps grpc.ServerStream allowing each Sent/Recv of message to increment counters.
+type monitoredServerStream struct {
+	grpc.ServerStream
+	monitor *serverReporter
+}
+
+func (s *monitoredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.monitor.SentMessage()
+	}
+	return err
+}
+
+func (s *monitoredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.monitor.ReceivedMessage()
+	} else if err == io.EOF {
+		return err
+	}
+	return err
+}
+
+func preRegisterMethod(metrics *ServerMetrics, serviceName string, mInfo *grpc.MethodInfo) {
+	fullMethod := "/" + serviceName + "/" + mInfo.Name
+	serviceName, methodName, keep := filterMethodLabels(metrics.methodFilter, fullMethod)
+	if !keep {
+		return
+	}
+	methodType := typeFromMethodInfo(mInfo)
+	metrics.serverStartedCounter.GetMetricWithLabelValues(string(methodType), serviceName, methodName)
+	metrics.serverStreamMsgReceived.GetMetricWithLabelValues(string(methodType), serviceName, methodName)
+	metrics.serverStreamMsgSent.GetMetricWithLabelValues(string(methodType), serviceName, methodName)
+	if metrics.serverHandledHistogramEnabled {
+		metrics.serverHandledHistogram.GetMetricWithLabelValues(string(methodType), serviceName, methodName)
+	}
+	if metrics.serverInFlightGaugeEnabled {
+		metrics.serverInFlightGauge.GetMetricWithLabelValues(string(methodType), serviceName, methodName)
+	}
+	if metrics.serverPayloadHistogramEnabled {
+		metrics.serverMsgReceivedBytesHistogram.GetMetricWithLabelValues(payloadGRPCType, serviceName, methodName)
+		metrics.serverMsgSentBytesHistogram.GetMetricWithLabelValues(payloadGRPCType, serviceName, methodName)
+	}
+	for _, code := range allCodes {
+		metrics.serverHandledCounter.GetMetricWithLabelValues(string(methodType), serviceName, methodName, code.String())
+	}
+}
+
+func typeFromMethodInfo(mInfo *grpc.MethodInfo) grpcType {
+	if !mInfo.IsClientStream && !mInfo.IsServerStream {
+		return Unary
+	}
+	if mInfo.IsClientStream && !mInfo.IsServerStream {
+		return ClientStream
+	}
+	if !mInfo.IsClientStream && mInfo.IsServerStream {
+		return ServerStream
+	}
+	return BidiStream
+}
+
+var allCodes = []codes.Code{
+	codes.OK, codes.Canceled, codes.Unknown, codes.InvalidArgument, codes.DeadlineExceeded, codes.NotFound,
+	codes.AlreadyExists, codes.PermissionDenied, codes.Unauthenticated, codes.ResourceExhausted,
+	codes.FailedPrecondition, codes.Aborted, codes.OutOfRange, codes.Unimplemented, codes.Internal,
+	codes.Unavailable, codes.DataLoss,
+}
+
+// serverReporter tracks the lifecycle of a single RPC and feeds the
+// corresponding metrics of the owning ServerMetrics.
+type serverReporter struct {
+	metrics     *ServerMetrics
+	rpcType     grpcType
+	serviceName string
+	methodName  string
+	startTime   time.Time
+}
+
+// newServerReporter resolves the service/method labels for fullMethod
+// through the configured MethodFilter and starts tracking the RPC. The
+// second return value is false when the filter asked for the RPC to be
+// dropped from observation entirely, in which case the returned reporter is
+// nil and must not be used.
+func newServerReporter(m *ServerMetrics, rpcType grpcType, fullMethod string) (*serverReporter, bool) {
+	serviceName, methodName, keep := filterMethodLabels(m.methodFilter, fullMethod)
+	if !keep {
+		return nil, false
+	}
+	r := &serverReporter{
+		metrics:     m,
+		rpcType:     rpcType,
+		serviceName: serviceName,
+		methodName:  methodName,
+		startTime:   time.Now(),
+	}
+	r.metrics.serverStartedCounter.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+	return r, true
+}
+
+func (r *serverReporter) ReceivedMessage() {
+	r.metrics.serverStreamMsgReceived.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *serverReporter) SentMessage() {
+	r.metrics.serverStreamMsgSent.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *serverReporter) InFlightInc() {
+	r.metrics.serverInFlightGauge.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Inc()
+}
+
+func (r *serverReporter) InFlightDec() {
+	r.metrics.serverInFlightGauge.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName).Dec()
+}
+
+func (r *serverReporter) Handled(ctx context.Context, code codes.Code) {
+	counter := r.metrics.serverHandledCounter.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName, code.String())
+	if exemplarCounter, ok := counter.(prom.ExemplarAdder); ok && r.metrics.exemplarFromCtx != nil {
+		if labels := r.metrics.exemplarFromCtx(ctx); labels != nil {
+			exemplarCounter.AddWithExemplar(1, labels)
+		} else {
+			counter.Inc()
+		}
+	} else {
+		counter.Inc()
+	}
+
+	if r.metrics.serverHandledHistogramEnabled {
+		elapsed := time.Since(r.startTime).Seconds()
+		histogram := r.metrics.serverHandledHistogram.WithLabelValues(string(r.rpcType), r.serviceName, r.methodName)
+		if exemplarObserver, ok := histogram.(prom.ExemplarObserver); ok && r.metrics.exemplarFromCtx != nil {
+			if labels := r.metrics.exemplarFromCtx(ctx); labels != nil {
+				exemplarObserver.ObserveWithExemplar(elapsed, labels)
+				return
+			}
+		}
+		histogram.Observe(elapsed)
+	}
+}
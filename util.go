@@ -0,0 +1,55 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpc_prometheus
+
+import (
+	"strings"
+)
+
+// grpcType represents the type of the gRPC call: unary, client streaming, server streaming, or bidirectional streaming.
+type grpcType string
+
+const (
+	Unary        grpcType = "unary"
+	ClientStream grpcType = "client_stream"
+	ServerStream grpcType = "server_stream"
+	BidiStream   grpcType = "bidi_stream"
+)
+
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/") // remove leading slash
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
+
+// MethodFilter lets callers drop or rewrite the service/method label values
+// derived from a full gRPC method name before they are used to record any
+// metric. Returning keep=false drops the RPC from observation entirely,
+// which is the escape hatch for high-cardinality or noisy methods (health
+// checks, reflection, ...) that would otherwise blow up series counts.
+// Returning a non-empty service/method rewrites the corresponding label
+// value; an empty string leaves that label as parsed from fullMethod.
+type MethodFilter func(fullMethod string) (service, method string, keep bool)
+
+// filterMethodLabels resolves the grpc_service/grpc_method label values for
+// fullMethod, applying filter if non-nil.
+func filterMethodLabels(filter MethodFilter, fullMethod string) (service, method string, keep bool) {
+	service, method = splitMethodName(fullMethod)
+	if filter == nil {
+		return service, method, true
+	}
+	filteredService, filteredMethod, keep := filter(fullMethod)
+	if !keep {
+		return "", "", false
+	}
+	if filteredService != "" {
+		service = filteredService
+	}
+	if filteredMethod != "" {
+		method = filteredMethod
+	}
+	return service, method, true
+}